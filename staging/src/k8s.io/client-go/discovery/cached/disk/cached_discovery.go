@@ -0,0 +1,674 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package disk provides a cached implementation of discovery.DiscoveryInterface backed by files
+// on disk under a configurable directory.
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	openapi_v2 "github.com/google/gnostic/openapiv2"
+	"golang.org/x/sync/singleflight"
+
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// CachedDiscoveryClient implements the functions that discovery server-supported API groups,
+// versions and resources, backed by a disk cache. It wraps a delegate discovery.DiscoveryInterface
+// and writes anything it fetches from that delegate to cacheDirectory, so that subsequent
+// processes (or subsequent calls within ttl) can reuse it without contacting the apiserver again.
+type CachedDiscoveryClient struct {
+	delegate discovery.DiscoveryInterface
+
+	// cacheDirectory is the directory where discovery docs are held. It must be unique per
+	// host:port combination to work well.
+	cacheDirectory string
+
+	// ttl is how long the cache should be considered valid.
+	ttl time.Duration
+
+	// negativeTTL, when non-zero, opts the client into caching "not found" results from
+	// ServerResourcesForGroupVersion for negativeTTL, so controllers that repeatedly probe
+	// optional CRDs don't hammer the apiserver with NotFound requests. It is disabled (zero) by
+	// default; enable it with WithNegativeTTL.
+	negativeTTL time.Duration
+
+	// flights collapses concurrent live lookups for the same method+groupVersion into a single
+	// delegate call, so a burst of callers hitting an empty or expired cache at the same time
+	// (e.g. many controllers starting up together) only sends the apiserver one request.
+	flights singleflight.Group
+
+	// mutex protects the fields below.
+	mutex sync.Mutex
+
+	// ourFiles are all filenames of cache files created by this process.
+	ourFiles map[string]struct{}
+	// invalidated is true if all cache files should be ignored that are not ours (e.g. after
+	// Invalidate() was called).
+	invalidated bool
+	// fresh is true if all used cache files were ours.
+	fresh bool
+}
+
+var _ discovery.CachedDiscoveryInterface = &CachedDiscoveryClient{}
+
+// aggregatedDiscoveryAccept is the content type negotiated for the aggregated discovery document
+// (every group, version and resource in a single response). Servers that don't recognize it
+// either ignore the header and answer their normal /apis response, or reject the path outright
+// with 404/406, both of which fetchAggregatedDiscovery treats as "not supported".
+const aggregatedDiscoveryAccept = "application/json;g=apidiscovery.k8s.io;v=v2beta1;as=APIGroupDiscoveryList"
+
+// ServerResourcesForGroupVersion returns the supported resources for a group and version.
+func (d *CachedDiscoveryClient) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	if d.negativeTTL > 0 {
+		if gr, ok := d.getNotFoundMarker(groupVersion); ok {
+			return nil, errors.NewNotFound(gr, "")
+		}
+	}
+
+	filename := filepath.Join(d.cacheDirectory, groupVersion, "serverresources.json")
+	cachedBytes, err := d.getCachedFile(filename)
+	if err == nil {
+		cachedResources := &metav1.APIResourceList{}
+		if err := json.Unmarshal(cachedBytes, cachedResources); err == nil {
+			klog.V(10).Infof("returning cached discovery info from %v", filename)
+			return cachedResources, nil
+		}
+	}
+
+	v, err, _ := d.flights.Do("resources/"+groupVersion, func() (interface{}, error) {
+		return d.delegate.ServerResourcesForGroupVersion(groupVersion)
+	})
+	liveResources, _ := v.(*metav1.APIResourceList)
+	if err != nil {
+		if d.negativeTTL > 0 && errors.IsNotFound(err) {
+			d.setNotFoundMarker(groupVersion)
+		}
+		klog.V(3).Infof("skipped caching discovery info due to %v", err)
+		return liveResources, err
+	}
+	if liveResources == nil || len(liveResources.APIResources) == 0 {
+		klog.V(3).Infof("skipped caching discovery info, no resources found")
+		return liveResources, err
+	}
+
+	if err := d.writeCachedFile(filename, liveResources); err != nil {
+		klog.V(1).Infof("failed to write cache to %v due to %v", filename, err)
+	}
+
+	return liveResources, nil
+}
+
+// ServerGroupsAndResources returns the supported groups and resources for all groups and
+// versions. It prefers the aggregated discovery document when the server supports it, falling
+// back to one ServerGroups call plus one ServerResourcesForGroupVersion call per group version
+// otherwise.
+func (d *CachedDiscoveryClient) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	if groups, resources, ok := d.aggregatedGroupsAndResources(); ok {
+		return groups, resources, nil
+	}
+	return fetchGroupsAndResources(d.ServerGroups, d.ServerResourcesForGroupVersion)
+}
+
+// fetchAggregatedDiscovery asks the delegate's RESTClient() for the aggregated discovery document
+// directly, the same way a real apiserver negotiates it: a GET against /apis with an Accept header
+// asking for the APIGroupDiscoveryList content type. A server that doesn't support it answers with
+// its normal /apis response or with 404/406; both are reported back as a nil, nil result so the
+// caller falls back to the per-group path.
+func (d *CachedDiscoveryClient) fetchAggregatedDiscovery() (*apidiscoveryv2beta1.APIGroupDiscoveryList, error) {
+	result := d.delegate.RESTClient().Get().AbsPath("/apis").SetHeader("Accept", aggregatedDiscoveryAccept).Do(context.Background())
+
+	var statusCode int
+	result.StatusCode(&statusCode)
+	if statusCode == http.StatusNotFound || statusCode == http.StatusNotAcceptable {
+		return nil, nil
+	}
+
+	body, err := result.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	list := &apidiscoveryv2beta1.APIGroupDiscoveryList{}
+	if err := json.Unmarshal(body, list); err != nil || (list.Kind != "" && list.Kind != "APIGroupDiscoveryList") {
+		// The server answered with its legacy /apis response (an APIGroupList, which decodes into
+		// an empty list without error) instead of the aggregated document; treat it the same as
+		// an explicit 404/406.
+		return nil, nil
+	}
+
+	return list, nil
+}
+
+// aggregatedUnsupportedMarkerPath is the sidecar written when the delegate reports that it doesn't
+// support the aggregated discovery endpoint (404/406), so that fact is remembered for d.ttl
+// instead of re-probing the endpoint on every single ServerGroupsAndResources call.
+func aggregatedUnsupportedMarkerPath(cacheDirectory string) string {
+	return filepath.Join(cacheDirectory, "aggregated.unsupported")
+}
+
+// aggregatedGroupsAndResources fetches (or reads from cache) the aggregated discovery document
+// and primes the ordinary servergroups/serverresources caches from it, so a single round trip
+// satisfies ServerGroups() and every ServerResourcesForGroupVersion() call that follows. The
+// returned bool is false when the server doesn't support the aggregated endpoint (reported as a
+// nil, nil result, and remembered for d.ttl so the probe isn't repeated on every call) or the
+// document could neither be read from cache nor fetched; the caller should fall back to the
+// per-group path.
+func (d *CachedDiscoveryClient) aggregatedGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, bool) {
+	filename := filepath.Join(d.cacheDirectory, "aggregated.json")
+	if cachedBytes, err := d.getCachedFile(filename); err == nil {
+		list := &apidiscoveryv2beta1.APIGroupDiscoveryList{}
+		if err := json.Unmarshal(cachedBytes, list); err == nil {
+			klog.V(10).Infof("returning cached aggregated discovery info from %v", filename)
+			return d.primeFromAggregated(list)
+		}
+	}
+
+	if _, err := d.getCachedFile(aggregatedUnsupportedMarkerPath(d.cacheDirectory)); err == nil {
+		klog.V(10).Infof("skipping aggregated discovery probe, cached as unsupported")
+		return nil, nil, false
+	}
+
+	v, err, _ := d.flights.Do("aggregated", func() (interface{}, error) {
+		return d.fetchAggregatedDiscovery()
+	})
+	if err != nil {
+		klog.V(3).Infof("skipped aggregated discovery due to %v", err)
+		return nil, nil, false
+	}
+	list, _ := v.(*apidiscoveryv2beta1.APIGroupDiscoveryList)
+	if list == nil {
+		// The server doesn't support the aggregated endpoint (404/406); remember that for d.ttl so
+		// every subsequent call doesn't pay for another live probe, and fall back.
+		if err := d.writeCachedFileBytes(aggregatedUnsupportedMarkerPath(d.cacheDirectory), func() ([]byte, error) { return []byte{}, nil }); err != nil {
+			klog.V(1).Infof("failed to write aggregated-unsupported marker due to %v", err)
+		}
+		return nil, nil, false
+	}
+
+	if err := d.writeCachedFile(filename, list); err != nil {
+		klog.V(1).Infof("failed to write aggregated discovery cache to %v due to %v", filename, err)
+	}
+
+	return d.primeFromAggregated(list)
+}
+
+// primeFromAggregated converts the aggregated discovery document into the classic APIGroup and
+// APIResourceList shapes, writing each one to the same disk cache files ServerGroups and
+// ServerResourcesForGroupVersion already read, so they don't need to contact the server again.
+func (d *CachedDiscoveryClient) primeFromAggregated(list *apidiscoveryv2beta1.APIGroupDiscoveryList) ([]*metav1.APIGroup, []*metav1.APIResourceList, bool) {
+	groupList := &metav1.APIGroupList{}
+	var resources []*metav1.APIResourceList
+
+	for _, item := range list.Items {
+		group := metav1.APIGroup{Name: item.Name}
+		for _, v := range item.Versions {
+			groupVersion := v.Version
+			if group.Name != "" {
+				groupVersion = group.Name + "/" + v.Version
+			}
+			group.Versions = append(group.Versions, metav1.GroupVersionForDiscovery{GroupVersion: groupVersion, Version: v.Version})
+
+			resourceList := &metav1.APIResourceList{GroupVersion: groupVersion}
+			for _, r := range v.Resources {
+				apiResource := metav1.APIResource{
+					Name:       r.Resource,
+					Namespaced: r.Scope == apidiscoveryv2beta1.ScopeNamespace,
+					Verbs:      metav1.Verbs(r.Verbs),
+				}
+				if r.ResponseKind != nil {
+					apiResource.Kind = r.ResponseKind.Kind
+				}
+				resourceList.APIResources = append(resourceList.APIResources, apiResource)
+			}
+
+			if err := d.writeCachedFile(filepath.Join(d.cacheDirectory, groupVersion, "serverresources.json"), resourceList); err != nil {
+				klog.V(1).Infof("failed to write cache for %v due to %v", groupVersion, err)
+			}
+			resources = append(resources, resourceList)
+		}
+		if len(group.Versions) > 0 {
+			group.PreferredVersion = group.Versions[0]
+		}
+		groupList.Groups = append(groupList.Groups, group)
+	}
+
+	if err := d.writeCachedFile(filepath.Join(d.cacheDirectory, "servergroups.json"), groupList); err != nil {
+		klog.V(1).Infof("failed to write servergroups cache due to %v", err)
+	}
+
+	groups := make([]*metav1.APIGroup, 0, len(groupList.Groups))
+	for i := range groupList.Groups {
+		groups = append(groups, &groupList.Groups[i])
+	}
+
+	return groups, resources, true
+}
+
+// fetchGroupsAndResources assembles the result of ServerGroupsAndResources from the (possibly
+// cached) groupsFn and resourcesFn. CachedDiscoveryClient uses it with its own ServerGroups and
+// ServerResourcesForGroupVersion as the per-group fallback, so that path goes through the disk
+// cache instead of bypassing it.
+func fetchGroupsAndResources(groupsFn func() (*metav1.APIGroupList, error), resourcesFn func(string) (*metav1.APIResourceList, error)) ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	groupList, err := groupsFn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var groups []*metav1.APIGroup
+	var resources []*metav1.APIResourceList
+	var failedGroupVersions []string
+	for i := range groupList.Groups {
+		group := &groupList.Groups[i]
+		groups = append(groups, group)
+		for _, version := range group.Versions {
+			resourceList, err := resourcesFn(version.GroupVersion)
+			if err != nil {
+				failedGroupVersions = append(failedGroupVersions, version.GroupVersion)
+				continue
+			}
+			resources = append(resources, resourceList)
+		}
+	}
+
+	if len(failedGroupVersions) > 0 {
+		return groups, resources, fmt.Errorf("unable to retrieve the complete list of server APIs: %v", failedGroupVersions)
+	}
+	return groups, resources, nil
+}
+
+// ServerGroups returns the supported groups, with information like supported versions and the
+// preferred version.
+func (d *CachedDiscoveryClient) ServerGroups() (*metav1.APIGroupList, error) {
+	filename := filepath.Join(d.cacheDirectory, "servergroups.json")
+	cachedBytes, err := d.getCachedFile(filename)
+	if err == nil {
+		cachedGroups := &metav1.APIGroupList{}
+		if err := json.Unmarshal(cachedBytes, cachedGroups); err == nil {
+			klog.V(10).Infof("returning cached discovery info from %v", filename)
+			return cachedGroups, nil
+		}
+	}
+
+	v, err, _ := d.flights.Do("servergroups", func() (interface{}, error) {
+		return d.delegate.ServerGroups()
+	})
+	if err != nil {
+		return nil, err
+	}
+	liveGroups := v.(*metav1.APIGroupList)
+	if liveGroups == nil || len(liveGroups.Groups) == 0 {
+		klog.V(3).Infof("skipped caching discovery info, no groups found")
+		return liveGroups, nil
+	}
+
+	if err := d.writeCachedFile(filename, liveGroups); err != nil {
+		klog.V(1).Infof("failed to write cache to %v due to %v", filename, err)
+	}
+
+	return liveGroups, nil
+}
+
+func (d *CachedDiscoveryClient) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return d.delegate.ServerPreferredResources()
+}
+
+func (d *CachedDiscoveryClient) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	return d.delegate.ServerPreferredNamespacedResources()
+}
+
+func (d *CachedDiscoveryClient) ServerVersion() (*version.Info, error) {
+	return d.delegate.ServerVersion()
+}
+
+// openAPIV2Accept is the content type negotiated for the binary-encoded OpenAPI v2 document.
+const openAPIV2Accept = "application/com.github.proto-openapi.spec.v2@v1.0+protobuf"
+
+// openAPISchemaMeta is the sidecar persisted alongside the cached OpenAPI document. ETag and
+// LastModified are copied verbatim from the response headers the apiserver returned for the fetch
+// that produced the cached document, so a later revalidation can send them back as preconditions
+// instead of guessing at them.
+type openAPISchemaMeta struct {
+	ETag         string `json:"eTag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func openAPISchemaMetaPath(cacheDirectory string) string {
+	return filepath.Join(cacheDirectory, "openapi", "v2.meta.json")
+}
+
+// OpenAPISchema returns the OpenAPI v2 document, reading it from the disk cache while the cached
+// entry is within ttl. Once it expires, and the delegate's RESTClient() is a *rest.RESTClient, it
+// revalidates with the apiserver using whatever ETag/Last-Modified headers were captured from the
+// last successful fetch, so a 304 only bumps the cache's timestamp instead of re-downloading and
+// re-decoding the whole document. Any other delegate is asked for the whole document again.
+func (d *CachedDiscoveryClient) OpenAPISchema() (*openapi_v2.Document, error) {
+	docPath := filepath.Join(d.cacheDirectory, "openapi", "v2.pb")
+
+	if cachedBytes, err := d.getCachedFile(docPath); err == nil {
+		doc := &openapi_v2.Document{}
+		if err := proto.Unmarshal(cachedBytes, doc); err == nil {
+			klog.V(10).Infof("returning cached openapi schema from %v", docPath)
+			return doc, nil
+		}
+	}
+
+	// discovery.DiscoveryInterface/rest.Result don't expose response headers, so a real ETag/
+	// Last-Modified is only reachable when the delegate's RESTClient() is the concrete
+	// *rest.RESTClient NewCachedDiscoveryClientForConfig always constructs, by going around
+	// Result and reading the *http.Response directly off its underlying http.Client. Delegates
+	// that don't satisfy that (e.g. test doubles) fall back to a plain unconditional refetch.
+	if rc, ok := d.delegate.RESTClient().(*restclient.RESTClient); ok {
+		return d.fetchOpenAPISchemaWithRevalidation(rc, docPath)
+	}
+	return d.fetchOpenAPISchemaUnconditionally(docPath)
+}
+
+// fetchOpenAPISchemaWithRevalidation fetches the OpenAPI v2 document over rc.Client directly
+// instead of through rc.Do(ctx), the only way to reach the server's real ETag/Last-Modified
+// response headers. The request carries whatever preconditions the last fetch's headers left in
+// the sidecar meta file; a 304 response is treated as a cache hit that only refreshes the cached
+// document's timestamp, never its contents.
+func (d *CachedDiscoveryClient) fetchOpenAPISchemaWithRevalidation(rc *restclient.RESTClient, docPath string) (*openapi_v2.Document, error) {
+	req, err := http.NewRequest(http.MethodGet, rc.Get().AbsPath("/openapi/v2").URL().String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", openAPIV2Accept)
+
+	staleBody, staleErr := ioutil.ReadFile(docPath)
+	if staleErr == nil {
+		if metaBytes, err := ioutil.ReadFile(openAPISchemaMetaPath(d.cacheDirectory)); err == nil {
+			meta := &openAPISchemaMeta{}
+			if err := json.Unmarshal(metaBytes, meta); err == nil {
+				if meta.ETag != "" {
+					req.Header.Set("If-None-Match", meta.ETag)
+				}
+				if meta.LastModified != "" {
+					req.Header.Set("If-Modified-Since", meta.LastModified)
+				}
+			}
+		}
+	}
+
+	resp, err := rc.Client.Do(req)
+	if err != nil {
+		klog.V(3).Infof("skipped caching openapi schema due to %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && staleErr == nil {
+		doc := &openapi_v2.Document{}
+		if err := proto.Unmarshal(staleBody, doc); err == nil {
+			klog.V(10).Infof("openapi schema not modified, refreshing cache timestamp for %v", docPath)
+			if err := d.writeCachedFileBytes(docPath, func() ([]byte, error) { return staleBody, nil }); err != nil {
+				klog.V(1).Infof("failed to refresh openapi cache timestamp for %v due to %v", docPath, err)
+			}
+			return doc, nil
+		}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching openapi schema: %v", resp.Status)
+	}
+
+	doc := &openapi_v2.Document{}
+	if err := proto.Unmarshal(body, doc); err != nil {
+		return nil, err
+	}
+
+	if err := d.writeCachedFileBytes(docPath, func() ([]byte, error) { return body, nil }); err != nil {
+		klog.V(1).Infof("failed to write openapi cache to %v due to %v", docPath, err)
+	}
+	meta, err := json.Marshal(openAPISchemaMeta{ETag: resp.Header.Get("Etag"), LastModified: resp.Header.Get("Last-Modified")})
+	if err == nil {
+		if err := d.writeCachedFileBytes(openAPISchemaMetaPath(d.cacheDirectory), func() ([]byte, error) { return meta, nil }); err != nil {
+			klog.V(1).Infof("failed to write openapi schema meta to %v due to %v", openAPISchemaMetaPath(d.cacheDirectory), err)
+		}
+	}
+
+	return doc, nil
+}
+
+// fetchOpenAPISchemaUnconditionally fetches the OpenAPI v2 document through the delegate directly,
+// for delegates whose RESTClient() isn't the concrete *rest.RESTClient, so their response headers
+// aren't reachable and conditional revalidation isn't possible.
+func (d *CachedDiscoveryClient) fetchOpenAPISchemaUnconditionally(docPath string) (*openapi_v2.Document, error) {
+	doc, err := d.delegate.OpenAPISchema()
+	if err != nil {
+		klog.V(3).Infof("skipped caching openapi schema due to %v", err)
+		return nil, err
+	}
+
+	body, err := proto.Marshal(doc)
+	if err != nil {
+		klog.V(1).Infof("failed to marshal openapi schema for caching due to %v", err)
+		return doc, nil
+	}
+	if err := d.writeCachedFileBytes(docPath, func() ([]byte, error) { return body, nil }); err != nil {
+		klog.V(1).Infof("failed to write openapi cache to %v due to %v", docPath, err)
+	}
+
+	return doc, nil
+}
+
+// notFoundMarker is the sidecar persisted for a groupVersion that the delegate reported as
+// NotFound, so the negative result can be replayed for negativeTTL without contacting the server.
+type notFoundMarker struct {
+	ObservedAt time.Time `json:"observedAt"`
+}
+
+func notFoundMarkerPath(cacheDirectory, groupVersion string) string {
+	return filepath.Join(cacheDirectory, groupVersion, "servergroup.notfound")
+}
+
+// getNotFoundMarker reports whether groupVersion has a still-fresh negative cache entry, and if
+// so, the GroupResource to synthesize the NotFound error for.
+func (d *CachedDiscoveryClient) getNotFoundMarker(groupVersion string) (schema.GroupResource, bool) {
+	filename := notFoundMarkerPath(d.cacheDirectory, groupVersion)
+
+	d.mutex.Lock()
+	_, ourFile := d.ourFiles[filename]
+	invalidated := d.invalidated
+	d.mutex.Unlock()
+	if invalidated && !ourFile {
+		return schema.GroupResource{}, false
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil || time.Since(info.ModTime()) > d.negativeTTL {
+		return schema.GroupResource{}, false
+	}
+
+	gv, _ := schema.ParseGroupVersion(groupVersion)
+	return gv.WithResource("").GroupResource(), true
+}
+
+// setNotFoundMarker records that groupVersion was not found as of now.
+func (d *CachedDiscoveryClient) setNotFoundMarker(groupVersion string) {
+	filename := notFoundMarkerPath(d.cacheDirectory, groupVersion)
+	if err := d.writeCachedFileBytes(filename, func() ([]byte, error) {
+		return json.Marshal(notFoundMarker{ObservedAt: time.Now()})
+	}); err != nil {
+		klog.V(1).Infof("failed to write negative discovery cache to %v due to %v", filename, err)
+	}
+}
+
+// WithNegativeTTL opts the client into caching "not found" ServerResourcesForGroupVersion results
+// for negativeTTL, separate from the success ttl. It returns the receiver so it can be chained
+// onto a constructor. Negative caching is disabled by default.
+func (d *CachedDiscoveryClient) WithNegativeTTL(negativeTTL time.Duration) *CachedDiscoveryClient {
+	d.negativeTTL = negativeTTL
+	return d
+}
+
+// RESTClient returns a RESTClient that is used to communicate with API server by this client
+// implementation.
+func (d *CachedDiscoveryClient) RESTClient() restclient.Interface {
+	return d.delegate.RESTClient()
+}
+
+// Fresh is supposed to tell the caller whether or not to retry if the cache fails to find
+// something due to an "unknown" reason. Callers should not invalidate the cache for any error
+// that Fresh returns true for.
+func (d *CachedDiscoveryClient) Fresh() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.fresh
+}
+
+// Invalidate enforces that no cached data that is older than the current call is used.
+func (d *CachedDiscoveryClient) Invalidate() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.ourFiles = map[string]struct{}{}
+	d.fresh = true
+	d.invalidated = true
+	if err := os.RemoveAll(filepath.Join(d.cacheDirectory, "openapi")); err != nil && !os.IsNotExist(err) {
+		klog.V(1).Infof("failed to remove openapi cache directory in %v due to %v", d.cacheDirectory, err)
+	}
+}
+
+// getCachedFile takes the filename and return the contents of the file as a byte slice. If the
+// file is older than the configured ttl, it returns an error so the caller falls back to a live
+// lookup. Once Invalidate() has been called, any file not written by this process during the
+// current invalidation period is also treated as stale.
+func (d *CachedDiscoveryClient) getCachedFile(filename string) ([]byte, error) {
+	d.mutex.Lock()
+	_, ourFile := d.ourFiles[filename]
+	if d.invalidated && !ourFile {
+		d.mutex.Unlock()
+		return nil, os.ErrNotExist
+	}
+	d.mutex.Unlock()
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(fileInfo.ModTime()) > d.ttl {
+		return nil, os.ErrNotExist
+	}
+
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.fresh = d.fresh && ourFile
+
+	return bytes, nil
+}
+
+// writeCachedFile writes obj to filename, json encoded, creating the parent directories if
+// needed. The file permissions are deliberately restrictive, since the discovery info may be used
+// by privileged processes.
+func (d *CachedDiscoveryClient) writeCachedFile(filename string, obj interface{}) error {
+	return d.writeCachedFileBytes(filename, func() ([]byte, error) { return json.Marshal(obj) })
+}
+
+func (d *CachedDiscoveryClient) writeCachedFileBytes(filename string, encode func() ([]byte, error)) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+
+	bytes, err := encode()
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(bytes); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0660); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.ourFiles[filename] = struct{}{}
+
+	return nil
+}
+
+// newCachedDiscoveryClient creates a new DiscoveryClient which caches discovery information to
+// disk, using the specified cache directory.
+func newCachedDiscoveryClient(delegate discovery.DiscoveryInterface, cacheDirectory string, ttl time.Duration) *CachedDiscoveryClient {
+	return &CachedDiscoveryClient{
+		delegate:       delegate,
+		cacheDirectory: cacheDirectory,
+		ttl:            ttl,
+		ourFiles:       map[string]struct{}{},
+		fresh:          true,
+	}
+}
+
+// NewCachedDiscoveryClientForConfig creates a new DiscoveryClient for the given config that
+// caches discovery information to cacheDirectory for ttl.
+func NewCachedDiscoveryClientForConfig(config *restclient.Config, cacheDirectory string, ttl time.Duration) (*CachedDiscoveryClient, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCachedDiscoveryClient(discoveryClient, cacheDirectory, ttl), nil
+}
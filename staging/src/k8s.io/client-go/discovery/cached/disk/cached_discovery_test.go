@@ -17,15 +17,20 @@ limitations under the License.
 package disk
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	openapi_v2 "github.com/google/gnostic/openapiv2"
 	"github.com/stretchr/testify/assert"
 
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -123,23 +128,385 @@ func TestNewCachedDiscoveryClient_PathPerm(t *testing.T) {
 	assert.NoError(err)
 }
 
+func TestCachedDiscoveryClient_AggregatedDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{
+		aggregatedDoc: &apidiscoveryv2beta1.APIGroupDiscoveryList{
+			Items: []apidiscoveryv2beta1.APIGroupDiscovery{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "a"},
+					Versions: []apidiscoveryv2beta1.APIVersionDiscovery{
+						{
+							Version: "v1",
+							Resources: []apidiscoveryv2beta1.APIResourceDiscovery{
+								{Resource: "widgets", ResponseKind: &metav1.GroupVersionKind{Kind: "Widget"}, Scope: apidiscoveryv2beta1.ScopeNamespace},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	cdc := newCachedDiscoveryClient(&c, d, 60*time.Second)
+
+	groups, resources, err := cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Len(groups, 1)
+	assert.Len(resources, 1)
+	assert.Equal(1, c.aggregatedFetches)
+	assert.Equal(0, c.groupCalls)
+	assert.Equal(0, c.resourceCalls)
+
+	_, err = cdc.ServerGroups()
+	assert.NoError(err)
+	assert.Equal(0, c.groupCalls, "ServerGroups should be satisfied from the primed cache")
+
+	_, err = cdc.ServerResourcesForGroupVersion("a/v1")
+	assert.NoError(err)
+	assert.Equal(0, c.resourceCalls, "ServerResourcesForGroupVersion should be satisfied from the primed cache")
+}
+
+func TestCachedDiscoveryClient_AggregatedDiscoveryFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{}
+	cdc := newCachedDiscoveryClient(&c, d, 60*time.Second)
+
+	groups, _, err := cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Len(groups, 1)
+	assert.Equal(1, c.groupCalls, "should fall back to the per-group path when aggregated discovery 404s")
+	assert.Equal(1, c.resourceCalls)
+}
+
+func TestCachedDiscoveryClient_AggregatedDiscoveryUnsupportedIsCached(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{}
+	cdc := newCachedDiscoveryClient(&c, d, 60*time.Second)
+
+	_, _, err = cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Equal(1, c.aggregatedFetches, "first call against a server without aggregated discovery should probe it once")
+
+	_, _, err = cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Equal(1, c.aggregatedFetches, "a repeated call within ttl should reuse the cached unsupported marker instead of probing again")
+
+	cdc.Invalidate()
+	_, _, err = cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Equal(2, c.aggregatedFetches, "Invalidate should clear the unsupported marker too")
+}
+
+func TestCachedDiscoveryClient_NegativeTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{}
+	cdc := newCachedDiscoveryClient(&c, d, 60*time.Second).WithNegativeTTL(1 * time.Second)
+
+	_, err = cdc.ServerResourcesForGroupVersion("missing/v1")
+	assert.True(errors.IsNotFound(err))
+	assert.Equal(c.resourceCalls, 1)
+
+	_, err = cdc.ServerResourcesForGroupVersion("missing/v1")
+	assert.True(errors.IsNotFound(err))
+	assert.Equal(c.resourceCalls, 1, "a NotFound within the negative TTL window should not hit the delegate again")
+
+	time.Sleep(1100 * time.Millisecond)
+
+	_, err = cdc.ServerResourcesForGroupVersion("missing/v1")
+	assert.True(errors.IsNotFound(err))
+	assert.Equal(c.resourceCalls, 2, "a NotFound after the negative TTL window should hit the delegate again")
+
+	cdc.Invalidate()
+	_, err = cdc.ServerResourcesForGroupVersion("missing/v1")
+	assert.True(errors.IsNotFound(err))
+	assert.Equal(c.resourceCalls, 3, "Invalidate should clear negative cache markers too")
+}
+
+func TestCachedDiscoveryClient_Singleflight(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	start := make(chan struct{})
+	c := fakeDiscoveryClient{
+		groupsHandler: func() (*metav1.APIGroupList, error) {
+			<-start
+			return (&fakeDiscoveryClient{}).serverGroups()
+		},
+		resourcesHandler: func(groupVersion string) (*metav1.APIResourceList, error) {
+			<-start
+			return &metav1.APIResourceList{APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget"}}}, nil
+		},
+	}
+	cdc := newCachedDiscoveryClient(&c, d, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cdc.ServerGroups()
+			assert.NoError(err)
+			_, err = cdc.ServerResourcesForGroupVersion("a/v1")
+			assert.NoError(err)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	assert.Equal(1, c.groupCalls, "50 concurrent callers against an empty cache should collapse to one live ServerGroups call")
+	assert.Equal(1, c.resourceCalls, "50 concurrent callers against an empty cache should collapse to one live ServerResourcesForGroupVersion call per groupVersion")
+}
+
+func TestMemoryCachedDiscoveryClient_TTL(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{}
+	cdc := NewCachedDiscoveryClientWithMemory(newCachedDiscoveryClient(&c, d, time.Minute), time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cdc.ServerGroups()
+			assert.NoError(err)
+			_, err = cdc.ServerResourcesForGroupVersion("a/v1")
+			assert.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(1, c.groupCalls, "concurrent callers within the memory TTL should share one underlying fetch")
+	assert.Equal(1, c.resourceCalls, "concurrent callers within the memory TTL should share one underlying fetch")
+
+	cdc.Invalidate()
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cdc.ServerGroups()
+			assert.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(2, c.groupCalls, "a fresh TTL window after Invalidate should allow exactly one more fetch")
+}
+
+func TestMemoryCachedDiscoveryClient_DistinctKeysDontSerialize(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	var mu sync.Mutex
+	inFlight := 0
+	bothInFlight := make(chan struct{})
+	var once sync.Once
+	release := make(chan struct{})
+
+	c := fakeDiscoveryClient{
+		resourcesHandler: func(groupVersion string) (*metav1.APIResourceList, error) {
+			mu.Lock()
+			inFlight++
+			n := inFlight
+			mu.Unlock()
+			if n == 2 {
+				once.Do(func() { close(bothInFlight) })
+			}
+			<-release
+			return &metav1.APIResourceList{APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget"}}}, nil
+		},
+	}
+	cdc := NewCachedDiscoveryClientWithMemory(newCachedDiscoveryClient(&c, d, time.Minute), time.Minute)
+
+	var wg sync.WaitGroup
+	for _, gv := range []string{"a/v1", "b/v1"} {
+		gv := gv
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cdc.ServerResourcesForGroupVersion(gv)
+			assert.NoError(err)
+		}()
+	}
+
+	select {
+	case <-bothInFlight:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServerResourcesForGroupVersion for distinct group versions should run concurrently instead of serializing behind the memory tier's lock")
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestMemoryCachedDiscoveryClient_ServerGroupsAndResourcesPrefersAggregated(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{
+		aggregatedDoc: &apidiscoveryv2beta1.APIGroupDiscoveryList{
+			Items: []apidiscoveryv2beta1.APIGroupDiscovery{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "a"},
+					Versions: []apidiscoveryv2beta1.APIVersionDiscovery{
+						{
+							Version: "v1",
+							Resources: []apidiscoveryv2beta1.APIResourceDiscovery{
+								{Resource: "widgets", ResponseKind: &metav1.GroupVersionKind{Kind: "Widget"}, Scope: apidiscoveryv2beta1.ScopeNamespace},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	cdc := NewCachedDiscoveryClientWithMemory(newCachedDiscoveryClient(&c, d, time.Minute), time.Minute)
+
+	groups, resources, err := cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Len(groups, 1)
+	assert.Len(resources, 1)
+	assert.Equal(1, c.aggregatedFetches, "memory tier should forward a cold ServerGroupsAndResources to the underlying aggregated path")
+	assert.Equal(0, c.groupCalls)
+	assert.Equal(0, c.resourceCalls)
+
+	_, _, err = cdc.ServerGroupsAndResources()
+	assert.NoError(err)
+	assert.Equal(1, c.aggregatedFetches, "a repeated call within the memory ttl should be served from memory")
+}
+
+// TestCachedDiscoveryClient_OpenAPISchema covers the TTL-bounded caching path used whenever the
+// delegate's RESTClient() isn't the concrete *rest.RESTClient (true of fakeDiscoveryClient here).
+// The ETag/Last-Modified revalidation path needs a real *rest.RESTClient talking to an httptest
+// server to exercise meaningfully, which doesn't fit this file's lightweight fakes; it isn't
+// covered by a test in this package.
+func TestCachedDiscoveryClient_OpenAPISchema(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer os.RemoveAll(d)
+
+	c := fakeDiscoveryClient{}
+	cdc := newCachedDiscoveryClient(&c, d, 60*time.Second)
+
+	doc, err := cdc.OpenAPISchema()
+	assert.NoError(err)
+	assert.NotNil(doc)
+	assert.Equal(1, c.openAPICalls, "first call should fetch from the delegate")
+
+	_, err = cdc.OpenAPISchema()
+	assert.NoError(err)
+	assert.Equal(1, c.openAPICalls, "second call within ttl should be served from the disk cache")
+
+	cdc = newCachedDiscoveryClient(&c, d, 1*time.Nanosecond)
+	_, err = cdc.OpenAPISchema()
+	assert.NoError(err)
+	assert.Equal(2, c.openAPICalls, "expired ttl should refetch from the delegate")
+
+	cdc.Invalidate()
+	_, err = cdc.OpenAPISchema()
+	assert.NoError(err)
+	assert.Equal(3, c.openAPICalls, "invalidate should drop the cached document")
+}
+
 type fakeDiscoveryClient struct {
+	// mu guards the call counters below, since tests exercise this fake from many goroutines.
+	mu            sync.Mutex
 	groupCalls    int
 	resourceCalls int
 	versionCalls  int
 	openAPICalls  int
 
+	// aggregatedDoc, when set, is served by RESTClient() for a GET against /apis, mirroring a
+	// server that supports the aggregated discovery document; a nil doc mirrors a server that
+	// doesn't support the aggregated endpoint, exercising the fallback path.
+	aggregatedDoc     *apidiscoveryv2beta1.APIGroupDiscoveryList
+	aggregatedFetches int
+
+	// groupsHandler and resourcesHandler, when set, let a test block and release a delegate
+	// call on demand to deterministically overlap concurrent callers.
+	groupsHandler    func() (*metav1.APIGroupList, error)
+	resourcesHandler func(groupVersion string) (*metav1.APIResourceList, error)
+
 	serverResourcesHandler func() ([]*metav1.APIResourceList, error)
 }
 
 var _ discovery.DiscoveryInterface = &fakeDiscoveryClient{}
 
+// RESTClient serves a GET against /apis, mirroring the aggregated discovery endpoint: it returns
+// the aggregated document as JSON when aggregatedDoc is set, or a 404 otherwise so callers exercise
+// CachedDiscoveryClient's fallback to the per-group path.
 func (c *fakeDiscoveryClient) RESTClient() restclient.Interface {
-	return &fake.RESTClient{}
+	return &fake.RESTClient{
+		Client: &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			c.mu.Lock()
+			c.aggregatedFetches++
+			c.mu.Unlock()
+
+			if c.aggregatedDoc == nil {
+				return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header), Body: http.NoBody}, nil
+			}
+
+			body, err := json.Marshal(c.aggregatedDoc)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewReader(body)),
+			}, nil
+		})},
+	}
 }
 
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
 func (c *fakeDiscoveryClient) ServerGroups() (*metav1.APIGroupList, error) {
+	c.mu.Lock()
 	c.groupCalls = c.groupCalls + 1
+	handler := c.groupsHandler
+	c.mu.Unlock()
+
+	if handler != nil {
+		return handler()
+	}
 	return c.serverGroups()
 }
 
@@ -164,7 +531,14 @@ func (c *fakeDiscoveryClient) serverGroups() (*metav1.APIGroupList, error) {
 }
 
 func (c *fakeDiscoveryClient) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	c.mu.Lock()
 	c.resourceCalls = c.resourceCalls + 1
+	handler := c.resourcesHandler
+	c.mu.Unlock()
+
+	if handler != nil {
+		return handler(groupVersion)
+	}
 	if groupVersion == "a/v1" {
 		return &metav1.APIResourceList{APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget"}}}, nil
 	}
@@ -173,7 +547,9 @@ func (c *fakeDiscoveryClient) ServerResourcesForGroupVersion(groupVersion string
 }
 
 func (c *fakeDiscoveryClient) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	c.mu.Lock()
 	c.resourceCalls = c.resourceCalls + 1
+	c.mu.Unlock()
 
 	gs, _ := c.serverGroups()
 	resultGroups := []*metav1.APIGroup{}
@@ -189,21 +565,29 @@ func (c *fakeDiscoveryClient) ServerGroupsAndResources() ([]*metav1.APIGroup, []
 }
 
 func (c *fakeDiscoveryClient) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	c.mu.Lock()
 	c.resourceCalls = c.resourceCalls + 1
+	c.mu.Unlock()
 	return nil, nil
 }
 
 func (c *fakeDiscoveryClient) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	c.mu.Lock()
 	c.resourceCalls = c.resourceCalls + 1
+	c.mu.Unlock()
 	return nil, nil
 }
 
 func (c *fakeDiscoveryClient) ServerVersion() (*version.Info, error) {
+	c.mu.Lock()
 	c.versionCalls = c.versionCalls + 1
+	c.mu.Unlock()
 	return &version.Info{}, nil
 }
 
 func (c *fakeDiscoveryClient) OpenAPISchema() (*openapi_v2.Document, error) {
+	c.mu.Lock()
 	c.openAPICalls = c.openAPICalls + 1
+	c.mu.Unlock()
 	return &openapi_v2.Document{}, nil
 }
@@ -0,0 +1,197 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package disk
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+)
+
+// memoryCacheMaxEntries bounds the number of distinct groups/group-versions the memory tier will
+// hold onto at once, so a cluster with a very large number of CRDs can't grow it unbounded.
+const memoryCacheMaxEntries = 256
+
+// memoryCachedDiscoveryClient adds a process-local, TTL-bounded LRU of decoded APIGroupList and
+// APIResourceList objects in front of a discovery.CachedDiscoveryInterface. Long-running
+// controllers that re-run discovery on every reconcile hit this tier instead of re-reading and
+// re-decoding JSON from disk on every call.
+type memoryCachedDiscoveryClient struct {
+	discovery.CachedDiscoveryInterface
+
+	ttl time.Duration
+
+	mutex     sync.Mutex
+	entries   map[string]*list.Element
+	evictList *list.List
+}
+
+var _ discovery.CachedDiscoveryInterface = &memoryCachedDiscoveryClient{}
+
+const groupsMemoryCacheKey = "servergroups"
+const groupsAndResourcesMemoryCacheKey = "groupsandresources"
+
+type memoryCacheEntry struct {
+	key       string
+	expiresAt time.Time
+	groups    *metav1.APIGroupList
+	resources *metav1.APIResourceList
+
+	// allGroups and allResources hold the combined result of ServerGroupsAndResources, cached as a
+	// unit under groupsAndResourcesMemoryCacheKey.
+	allGroups    []*metav1.APIGroup
+	allResources []*metav1.APIResourceList
+}
+
+// ServerGroups returns the supported groups, with information like supported versions and the
+// preferred version. The delegate call is made with c.mutex released, so a slow or blocking
+// in-flight lookup for one key doesn't serialize unrelated concurrent lookups behind it.
+func (c *memoryCachedDiscoveryClient) ServerGroups() (*metav1.APIGroupList, error) {
+	c.mutex.Lock()
+	if entry := c.getLocked(groupsMemoryCacheKey); entry != nil {
+		defer c.mutex.Unlock()
+		return entry.groups, nil
+	}
+	c.mutex.Unlock()
+
+	groups, err := c.CachedDiscoveryInterface.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.setLocked(&memoryCacheEntry{key: groupsMemoryCacheKey, groups: groups})
+	c.mutex.Unlock()
+	return groups, nil
+}
+
+// ServerResourcesForGroupVersion returns the supported resources for a group and version. The
+// delegate call is made with c.mutex released, so a slow or blocking in-flight lookup for one
+// group version doesn't serialize unrelated concurrent lookups behind it.
+func (c *memoryCachedDiscoveryClient) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	key := "resources/" + groupVersion
+
+	c.mutex.Lock()
+	if entry := c.getLocked(key); entry != nil {
+		defer c.mutex.Unlock()
+		return entry.resources, nil
+	}
+	c.mutex.Unlock()
+
+	resources, err := c.CachedDiscoveryInterface.ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.setLocked(&memoryCacheEntry{key: key, resources: resources})
+	c.mutex.Unlock()
+	return resources, nil
+}
+
+// ServerGroupsAndResources returns the supported groups and resources for all groups and
+// versions. On a memory cache miss it forwards straight to the underlying
+// discovery.CachedDiscoveryInterface rather than decomposing into ServerGroups plus one
+// ServerResourcesForGroupVersion per group version, so a delegate that can satisfy this in a
+// single round trip (e.g. the disk client's aggregated discovery path) isn't forced back onto the
+// O(groups) path.
+func (c *memoryCachedDiscoveryClient) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	c.mutex.Lock()
+	if entry := c.getLocked(groupsAndResourcesMemoryCacheKey); entry != nil {
+		defer c.mutex.Unlock()
+		return entry.allGroups, entry.allResources, nil
+	}
+	c.mutex.Unlock()
+
+	groups, resources, err := c.CachedDiscoveryInterface.ServerGroupsAndResources()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.mutex.Lock()
+	c.setLocked(&memoryCacheEntry{key: groupsAndResourcesMemoryCacheKey, allGroups: groups, allResources: resources})
+	c.mutex.Unlock()
+	return groups, resources, nil
+}
+
+// Invalidate invalidates the underlying disk cache and clears the memory tier while still holding
+// c.mutex, so no concurrent ServerGroups/ServerResourcesForGroupVersion/ServerGroupsAndResources
+// call can read the not-yet-invalidated disk cache and repopulate the memory tier with stale data
+// in between the two steps.
+func (c *memoryCachedDiscoveryClient) Invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.CachedDiscoveryInterface.Invalidate()
+	c.entries = map[string]*list.Element{}
+	c.evictList = list.New()
+}
+
+// getLocked returns the still-fresh entry stored under key, or nil if there isn't one. c.mutex
+// must be held.
+func (c *memoryCachedDiscoveryClient) getLocked(key string) *memoryCacheEntry {
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := elem.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.evictList.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+
+	c.evictList.MoveToFront(elem)
+	return entry
+}
+
+// setLocked stores entry, evicting the least recently used entry if the cache is over capacity.
+// c.mutex must be held.
+func (c *memoryCachedDiscoveryClient) setLocked(entry *memoryCacheEntry) {
+	if elem, ok := c.entries[entry.key]; ok {
+		c.evictList.Remove(elem)
+	}
+
+	entry.expiresAt = time.Now().Add(c.ttl)
+	c.entries[entry.key] = c.evictList.PushFront(entry)
+
+	for len(c.entries) > memoryCacheMaxEntries {
+		oldest := c.evictList.Back()
+		if oldest == nil {
+			break
+		}
+		c.evictList.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+// NewCachedDiscoveryClientWithMemory wraps delegate (typically the result of
+// NewCachedDiscoveryClientForConfig) with a process-local LRU, so repeated calls from within this
+// process don't pay the cost of re-reading and re-decoding the disk cache. Entries are considered
+// fresh for ttl, mirroring the disk cache's own TTL semantics, and Invalidate() clears both tiers.
+func NewCachedDiscoveryClientWithMemory(delegate discovery.CachedDiscoveryInterface, ttl time.Duration) discovery.CachedDiscoveryInterface {
+	return &memoryCachedDiscoveryClient{
+		CachedDiscoveryInterface: delegate,
+		ttl:                      ttl,
+		entries:                  map[string]*list.Element{},
+		evictList:                list.New(),
+	}
+}